@@ -0,0 +1,200 @@
+// Package bridge pushes the exporter's gathered metrics to a Graphite
+// server over TCP, for deployments with a pre-existing Graphite/Carbon
+// pipeline that want TWAMP jitter/loss without running Prometheus. It is
+// modeled on the now-removed prometheus/client_golang/prometheus/graphite
+// bridge.
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultInterval is how often a Bridge pushes to Graphite when Config
+// doesn't set one.
+const DefaultInterval = 15 * time.Second
+
+// ErrorHandling defines how Push reacts to a failed gather.
+type ErrorHandling int
+
+const (
+	// ContinueOnError pushes whatever metrics were gathered, logging the
+	// gather error rather than aborting the push.
+	ContinueOnError ErrorHandling = iota
+	// AbortOnError skips the push entirely if gathering returned an error.
+	AbortOnError
+)
+
+// Config defines the Graphite bridge config.
+type Config struct {
+	// URL is the host:port of the Graphite/Carbon line-receiver to push
+	// to. Required.
+	URL string
+
+	// Prefix is prepended to every metric name pushed.
+	Prefix string
+
+	// Interval is how often to push. Defaults to DefaultInterval.
+	Interval time.Duration
+
+	// Timeout bounds dialing and writing to URL. Defaults to Interval.
+	Timeout time.Duration
+
+	// Gatherer is where metrics are gathered from. Defaults to
+	// prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+
+	// ErrorHandling controls what Push does when Gatherer.Gather fails.
+	ErrorHandling ErrorHandling
+}
+
+// Bridge pushes metrics gathered from a Config.Gatherer to a Graphite
+// server at a regular interval.
+type Bridge struct {
+	url      string
+	prefix   string
+	interval time.Duration
+	timeout  time.Duration
+
+	errorHandling ErrorHandling
+	gatherer      prometheus.Gatherer
+}
+
+// NewBridge returns a pointer to a new Bridge built from cfg.
+func NewBridge(cfg *Config) (*Bridge, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("missing URL")
+	}
+
+	b := &Bridge{
+		url:           cfg.URL,
+		prefix:        cfg.Prefix,
+		errorHandling: cfg.ErrorHandling,
+	}
+
+	if cfg.Gatherer != nil {
+		b.gatherer = cfg.Gatherer
+	} else {
+		b.gatherer = prometheus.DefaultGatherer
+	}
+
+	if cfg.Interval != 0 {
+		b.interval = cfg.Interval
+	} else {
+		b.interval = DefaultInterval
+	}
+
+	if cfg.Timeout != 0 {
+		b.timeout = cfg.Timeout
+	} else {
+		b.timeout = b.interval
+	}
+
+	return b, nil
+}
+
+// Run pushes to Graphite every interval until ctx is canceled.
+func (b *Bridge) Run(ctx context.Context, logger log.Logger) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Push(); err != nil {
+				level.Error(logger).Log("msg", "Error pushing to Graphite", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push gathers metrics once and writes them to the configured Graphite
+// server over a freshly-dialed TCP connection.
+func (b *Bridge) Push() error {
+	mfs, err := b.gatherer.Gather()
+	if err != nil {
+		if b.errorHandling == AbortOnError {
+			return fmt.Errorf("gathering metrics: %w", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", b.url, b.timeout)
+	if err != nil {
+		return fmt.Errorf("dialing graphite: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(b.timeout))
+
+	return writeMetrics(conn, mfs, b.prefix, model.Now())
+}
+
+func writeMetrics(conn net.Conn, mfs []*dto.MetricFamily, prefix string, now model.Time) error {
+	vec, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: now}, mfs...)
+	if err != nil {
+		return fmt.Errorf("extracting samples: %w", err)
+	}
+
+	w := bufio.NewWriter(conn)
+	for _, s := range vec {
+		line := graphiteLine(prefix, s.Metric, float64(s.Value), int64(s.Timestamp)/1000)
+		if _, err := w.WriteString(line); err != nil {
+			return fmt.Errorf("writing to graphite: %w", err)
+		}
+	}
+	return w.Flush()
+}
+
+// graphiteLine renders a single sample as Graphite's plaintext protocol
+// line: prefix.metric_name.labelkey.labelvalue value timestamp_seconds\n.
+// Labels are sorted so the same series always produces the same path.
+func graphiteLine(prefix string, m model.Metric, value float64, timestamp int64) string {
+	name := sanitize(string(m[model.MetricNameLabel]))
+
+	labels := make([]string, 0, len(m))
+	for label, v := range m {
+		if label == model.MetricNameLabel {
+			continue
+		}
+		labels = append(labels, sanitize(fmt.Sprintf("%s.%s", label, v)))
+	}
+	sort.Strings(labels)
+
+	path := name
+	if prefix != "" {
+		path = prefix + "." + path
+	}
+	for _, l := range labels {
+		path += "." + l
+	}
+
+	return fmt.Sprintf("%s %g %d\n", path, value, timestamp)
+}
+
+// sanitize replaces characters Graphite treats specially in a metric path
+// (":" separates carbon's internal aggregation functions, spaces break the
+// plaintext protocol's field separation) with underscores.
+func sanitize(s string) string {
+	out := []rune(s)
+	for i, c := range out {
+		if c == ':' || c == ' ' {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
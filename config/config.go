@@ -0,0 +1,244 @@
+// Package config loads the YAML file that defines the named TWAMP modules
+// an operator can select via the `module` query parameter on /probe,
+// following the same pattern blackbox_exporter uses for its own modules.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tcaine/twamp"
+	"gopkg.in/yaml.v3"
+)
+
+// dscpValues maps the DSCP/TOS names operators write in YAML to the TOS
+// octet values the twamp package expects when negotiating a session.
+var dscpValues = map[string]int{
+	"be":   twamp.BE,
+	"cs1":  twamp.CS1,
+	"af11": twamp.AF11,
+	"af12": twamp.AF12,
+	"af13": twamp.AF13,
+	"cs2":  twamp.CS2,
+	"af21": twamp.AF21,
+	"af22": twamp.AF22,
+	"af23": twamp.AF23,
+	"cs3":  twamp.CS3,
+	"af31": twamp.AF31,
+	"af32": twamp.AF32,
+	"af33": twamp.AF33,
+	"cs4":  twamp.CS4,
+	"af41": twamp.AF41,
+	"af42": twamp.AF42,
+	"af43": twamp.AF43,
+	"cs5":  twamp.CS5,
+	"ef":   twamp.EF,
+	"cs6":  twamp.CS6,
+	"cs7":  twamp.CS7,
+}
+
+// Default values applied to a module before validation, matching the
+// behavior that used to be hard-coded in probeTWAMP.
+const (
+	DefaultControlPort   = 862
+	DefaultSenderPort    = 6667
+	DefaultReceiverPort  = 6667
+	DefaultTimeout       = 2 * time.Second
+	DefaultPadding       = 42
+	DefaultDSCP          = "be"
+	DefaultProbeCount    = 3
+	DefaultProbeInterval = time.Second
+	DefaultSessionExpiry = 5 * time.Minute
+	DefaultProber        = "twamp_sender"
+
+	// ProbeDeadlineMargin is added on top of a module's own probe_count,
+	// probe_interval, and timeout by ProbeDeadline, to leave room for the
+	// TWAMP-Control handshake and the final reply's timeout wait.
+	ProbeDeadlineMargin = 5 * time.Second
+
+	// maxProbeSpan bounds probe_count*probe_interval, the total time a
+	// module's probe sequence spends transmitting. It's also the guard
+	// against that multiplication overflowing time.Duration, since either
+	// factor alone can be made small enough to pass its own check while
+	// their product still overflows.
+	maxProbeSpan = 24 * time.Hour
+)
+
+// Module describes the TWAMP parameters used to probe a target, e.g. a
+// "voip_ef" module running 20 probes at DSCP EF versus a "bulk_be" module
+// running 3 probes at DSCP BE against the same targets.
+type Module struct {
+	// Prober selects which entry of prober.Probers runs this module.
+	Prober string `yaml:"prober,omitempty"`
+	// ControlPort is the TCP port the Test-Session-Reflector listens on
+	// for the TWAMP-Control handshake (RFC 4656 calls this port 862).
+	ControlPort   int           `yaml:"control_port,omitempty"`
+	SenderPort    int           `yaml:"sender_port,omitempty"`
+	ReceiverPort  int           `yaml:"receiver_port,omitempty"`
+	Timeout       time.Duration `yaml:"timeout,omitempty"`
+	Padding       int           `yaml:"padding,omitempty"`
+	DSCP          string        `yaml:"dscp,omitempty"`
+	ProbeCount    uint64        `yaml:"probe_count,omitempty"`
+	ProbeInterval time.Duration `yaml:"probe_interval,omitempty"`
+	// SessionExpiry is how long an idle TWAMP session may sit in the
+	// session cache before it is torn down.
+	SessionExpiry time.Duration `yaml:"session_expiry,omitempty"`
+}
+
+// TOS resolves the module's configured DSCP name to the TOS octet value
+// expected by twamp.TwampSessionConfig.
+func (m Module) TOS() (int, error) {
+	dscp := strings.ToLower(m.DSCP)
+	if dscp == "" {
+		dscp = DefaultDSCP
+	}
+	tos, ok := dscpValues[dscp]
+	if !ok {
+		return 0, fmt.Errorf("unknown dscp value %q", m.DSCP)
+	}
+	return tos, nil
+}
+
+// ProbeDeadline estimates an upper bound on how long one ad-hoc /probe
+// against this module can take: transmitting probe_count packets
+// probe_interval apart, plus the control/test timeout, plus
+// ProbeDeadlineMargin. A fixed deadline doesn't work across modules since
+// e.g. voip_ef's 20 packets at 200ms apart already take ~4s to send before
+// the timeout or handshake are even counted.
+func (m Module) ProbeDeadline() time.Duration {
+	return time.Duration(m.ProbeCount)*m.ProbeInterval + m.Timeout + ProbeDeadlineMargin
+}
+
+func (m *Module) applyDefaults() {
+	if m.Prober == "" {
+		m.Prober = DefaultProber
+	}
+	if m.ControlPort == 0 {
+		m.ControlPort = DefaultControlPort
+	}
+	if m.SenderPort == 0 {
+		m.SenderPort = DefaultSenderPort
+	}
+	if m.ReceiverPort == 0 {
+		m.ReceiverPort = DefaultReceiverPort
+	}
+	if m.Timeout == 0 {
+		m.Timeout = DefaultTimeout
+	}
+	if m.Padding == 0 {
+		m.Padding = DefaultPadding
+	}
+	if m.DSCP == "" {
+		m.DSCP = DefaultDSCP
+	}
+	if m.ProbeCount == 0 {
+		m.ProbeCount = DefaultProbeCount
+	}
+	if m.ProbeInterval == 0 {
+		m.ProbeInterval = DefaultProbeInterval
+	}
+	if m.SessionExpiry == 0 {
+		m.SessionExpiry = DefaultSessionExpiry
+	}
+}
+
+// Validate checks that a module's parameters are usable, returning the
+// first problem found.
+func (m Module) Validate() error {
+	if _, err := m.TOS(); err != nil {
+		return err
+	}
+	if m.ControlPort <= 0 || m.ControlPort > 65535 {
+		return fmt.Errorf("control_port %d out of range", m.ControlPort)
+	}
+	if m.Padding < 0 {
+		return fmt.Errorf("padding must not be negative")
+	}
+	if m.ProbeInterval <= 0 {
+		return fmt.Errorf("probe_interval must be positive")
+	}
+	if span := time.Duration(m.ProbeCount) * m.ProbeInterval; span/m.ProbeInterval != time.Duration(m.ProbeCount) || span > maxProbeSpan {
+		// ProbeDeadline computes this same product as a time.Duration; an
+		// overflowed or just absurdly long probe_count*probe_interval would
+		// turn it into a bogus (possibly negative) /probe deadline.
+		return fmt.Errorf("probe_count * probe_interval must not exceed %s, got %d * %s", maxProbeSpan, m.ProbeCount, m.ProbeInterval)
+	}
+	if (m.Prober == "twamp_sender" || m.Prober == "twamp_reflector") && m.Timeout < time.Second {
+		// dialSession passes int(m.Timeout.Seconds()) to twamp's session
+		// config, which the library turns into a read deadline; a
+		// sub-second timeout truncates to 0 there and the library reads
+		// with an already-expired deadline, failing every control and
+		// test read. tcp_connect and icmp use m.Timeout directly with no
+		// such truncation, so sub-second timeouts are fine for them.
+		return fmt.Errorf("timeout must be at least 1s for prober %q, got %s", m.Prober, m.Timeout)
+	}
+	return nil
+}
+
+// Config is the top-level structure of the YAML config file.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+	// Targets lists (module, target) pairs to probe continuously in the
+	// background, in addition to whatever ad-hoc targets are passed to
+	// /probe.
+	Targets []TargetConfig `yaml:"targets,omitempty"`
+}
+
+// TargetConfig pairs a target with the module used to probe it.
+type TargetConfig struct {
+	Target string `yaml:"target"`
+	Module string `yaml:"module"`
+}
+
+// SafeConfig wraps a Config behind a RWMutex so a SIGHUP-triggered reload
+// can swap it in atomically while probes in flight keep using a consistent
+// snapshot.
+type SafeConfig struct {
+	mu sync.RWMutex
+	c  *Config
+}
+
+// Get returns the currently loaded config.
+func (sc *SafeConfig) Get() *Config {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.c
+}
+
+// ReloadConfig reads and parses confFile, validates every module in it, and
+// only then swaps it in as the current config. A bad file leaves the
+// previously loaded config in place.
+func (sc *SafeConfig) ReloadConfig(confFile string) error {
+	b, err := os.ReadFile(confFile)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	c := &Config{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+
+	for name, m := range c.Modules {
+		m.applyDefaults()
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("module %q: %w", name, err)
+		}
+		c.Modules[name] = m
+	}
+
+	for _, t := range c.Targets {
+		if _, ok := c.Modules[t.Module]; !ok {
+			return fmt.Errorf("target %q: unknown module %q", t.Target, t.Module)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.c = c
+	sc.mu.Unlock()
+
+	return nil
+}
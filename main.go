@@ -2,230 +2,108 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/tcaine/twamp"
-)
-
-type Output struct {
-	Results any   `json:"results"`
-	Stat    Stats `json:"stats"`
-}
-
-type Stats struct {
-	Min         time.Duration `json:"min"`
-	Max         time.Duration `json:"max"`
-	Avg         time.Duration `json:"avg"`
-	StdDev      time.Duration `json:"stddev"`
-	Transmitted int           `json:"tx"`
-	Received    int           `json:"rx"`
-	Loss        float64       `json:"loss"`
-}
-
-type twampSession struct {
-	conn    *twamp.TwampConnection
-	session *twamp.TwampSession
-	test    *twamp.TwampTest
-	mu      sync.Mutex
-}
+	"github.com/prometheus/common/promlog"
+	"gopkg.in/yaml.v3"
 
-var (
-	sessionCache = make(map[string]*twampSession)
-	cacheMu      sync.Mutex
+	"github.com/adammmmm/twamp-exporter/bridge"
+	"github.com/adammmmm/twamp-exporter/config"
+	"github.com/adammmmm/twamp-exporter/prober"
 )
 
-func getOrCreateSession(target string) (*twampSession, error) {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
-
-	if s, ok := sessionCache[target]; ok {
-		return s, nil
-	}
-
-	addr := fmt.Sprintf("%s:862", target)
-	c := twamp.NewClient()
-
-	conn, err := c.Connect(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	session, err := conn.CreateSession(twamp.TwampSessionConfig{
-		SenderPort:   6667,
-		ReceiverPort: 6667,
-		Timeout:      2,
-		Padding:      42,
-		TOS:          twamp.BE,
-	})
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
+var (
+	configFile    = flag.String("config.file", "twamp.yml", "TWAMP exporter configuration file.")
+	listenAddress = flag.String("web.listen-address", ":9853", "The address to listen on for HTTP requests.")
 
-	test, err := session.CreateTest()
-	if err != nil {
-		session.Stop()
-		conn.Close()
-		return nil, err
-	}
+	graphiteAddress  = flag.String("graphite.address", "", "Graphite/Carbon address to push metrics to, e.g. localhost:2003. Disabled if empty.")
+	graphitePrefix   = flag.String("graphite.prefix", "twamp_exporter", "Prefix prepended to every metric pushed to Graphite.")
+	graphiteInterval = flag.Duration("graphite.interval", bridge.DefaultInterval, "How often to push metrics to Graphite.")
 
-	s := &twampSession{
-		conn:    conn,
-		session: session,
-		test:    test,
-	}
+	sessionMax         = flag.Int("session.max", prober.DefaultSessionCacheMax, "Maximum number of cached TWAMP sessions to keep open at once.")
+	sessionIdleTimeout = flag.Duration("session.idle-timeout", prober.DefaultSessionIdleTimeout, "Evict a cached TWAMP session after it sits unused this long.")
 
-	sessionCache[target] = s
-	log.Printf("Created persistent TWAMP session+test for %s", target)
-	return s, nil
-}
-
-func deleteSession(target string) {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
+	promlogConfig = promlog.Config{Level: &promlog.AllowedLevel{}, Format: &promlog.AllowedFormat{}}
+)
 
-	if s, ok := sessionCache[target]; ok {
-		s.session.Stop()
-		s.conn.Close()
-		delete(sessionCache, target)
-		log.Printf("Deleted TWAMP session for %s", target)
-	}
+func init() {
+	promlogConfig.Level.Set("info")
+	promlogConfig.Format.Set("logfmt")
+	flag.Var(promlogConfig.Level, "log.level", "Only log messages with the given severity or above. One of: [debug, info, warn, error]")
+	flag.Var(promlogConfig.Format, "log.format", "Output format of log messages. One of: [logfmt, json]")
 }
 
-func shutdownAllSessions() {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
+func main() {
+	flag.Parse()
 
-	log.Println("Shutting down TWAMP sessions")
+	logger := promlog.New(&promlogConfig)
 
-	for target, s := range sessionCache {
-		log.Printf("Stopping TWAMP session for %s", target)
-		s.session.Stop()
-		s.conn.Close()
+	sc := &config.SafeConfig{}
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		level.Error(logger).Log("msg", "Error loading config", "err", err)
+		os.Exit(1)
 	}
-
-	sessionCache = make(map[string]*twampSession)
-}
-
-func probeTWAMP(ctx context.Context, target string, registry *prometheus.Registry) bool {
-	durationGaugeVec := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "twamp_duration_seconds",
-			Help: "min/max/avg/stddev of twamp measurement",
-		},
-		[]string{"measurement"},
-	)
-	lostProbesGauge := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "twamp_probes_lost",
-			Help: "Lost probes per measurement",
-		},
-	)
-
-	registry.MustRegister(durationGaugeVec)
-	registry.MustRegister(lostProbesGauge)
-
-	s, err := getOrCreateSession(target)
-	if err != nil {
-		log.Printf("TWAMP session error for %s: %v", target, err)
-		return false
+	level.Info(logger).Log("msg", "Loaded config file", "file", *configFile)
+
+	var bridgeCancel context.CancelFunc
+	if *graphiteAddress != "" {
+		b, err := bridge.NewBridge(&bridge.Config{
+			URL:      *graphiteAddress,
+			Prefix:   *graphitePrefix,
+			Interval: *graphiteInterval,
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating Graphite bridge", "err", err)
+			os.Exit(1)
+		}
+		var bridgeCtx context.Context
+		bridgeCtx, bridgeCancel = context.WithCancel(context.Background())
+		go b.Run(bridgeCtx, logger)
+		level.Info(logger).Log("msg", "Pushing metrics to Graphite", "address", *graphiteAddress, "interval", *graphiteInterval)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	prober.DefaultCache = prober.NewCache(*sessionMax, *sessionIdleTimeout)
+	cacheCtx, cacheCancel := context.WithCancel(context.Background())
+	go prober.DefaultCache.Run(cacheCtx, logger)
 
-	stop := make(chan bool)
-	done := make(chan struct{})
+	schedulerCtx, schedulerCancel := context.WithCancel(context.Background())
+	go prober.NewScheduler(logger).Run(schedulerCtx, sc)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		select {
-		case <-ctx.Done():
-			close(stop)
-		case <-done:
+		for range hup {
+			if err := sc.ReloadConfig(*configFile); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded config file")
 		}
 	}()
 
-	results, err := s.test.RunMultiple(
-		3,
-		nil,
-		time.Second,
-		stop,
-	)
-	close(done)
-
-	if err != nil {
-		if err == io.EOF || strings.Contains(err.Error(), "EOF") {
-			deleteSession(target)
-		}
-		log.Printf("RunMultiple failed for %s: %v", target, err)
-		return false
-	}
-
-	var o Output
-	if err := json.Unmarshal([]byte(s.test.ReturnJSON(results)), &o); err != nil {
-		log.Printf("JSON parse failed: %v", err)
-		return false
-	}
-
-	durationGaugeVec.WithLabelValues("min").Set(o.Stat.Min.Seconds())
-	durationGaugeVec.WithLabelValues("max").Set(o.Stat.Max.Seconds())
-	durationGaugeVec.WithLabelValues("avg").Set(o.Stat.Avg.Seconds())
-	durationGaugeVec.WithLabelValues("stddev").Set(o.Stat.StdDev.Seconds())
-	lostProbesGauge.Set(o.Stat.Loss)
-
-	return true
-}
-
-func probeHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	target := r.URL.Query().Get("target")
-	if target == "" {
-		http.Error(w, "target parameter is required", http.StatusBadRequest)
-		return
-	}
-
-	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "probe_success",
-		Help: "Displays whether or not the probe was successful",
-	})
-	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "probe_duration_seconds",
-		Help: "Duration of the probe",
-	})
-
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(probeSuccess)
-	registry.MustRegister(probeDuration)
-
-	probeSuccess.Set(0)
-
-	start := time.Now()
-	if probeTWAMP(ctx, target, registry) {
-		probeSuccess.Set(1)
-	}
-	probeDuration.Set(time.Since(start).Seconds())
-
-	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-}
-
-func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/probe", probeHandler)
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		prober.Handler(w, r, sc.Get(), logger)
+	})
+	mux.HandleFunc("/probe/history", prober.HistoryHandler)
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		b, err := yaml.Marshal(sc.Get())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(b)
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
 		fmt.Fprint(w, `
 <html>
@@ -234,16 +112,19 @@ func main() {
 <h1>TWAMP Exporter</h1>
 <form action="/probe">
 Target: <input name="target" value="192.168.100.1">
+Module: <input name="module" value="default">
 <input type="submit" value="Probe">
 </form>
 <p><a href="/metrics">Metrics</a></p>
+<p><a href="/config">Configuration</a></p>
+<p><a href="/probe/history">Probe history</a></p>
 </body>
 </html>
 `)
 	})
 
 	server := &http.Server{
-		Addr:    ":9853",
+		Addr:    *listenAddress,
 		Handler: mux,
 	}
 
@@ -251,20 +132,27 @@ Target: <input name="target" value="192.168.100.1">
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		log.Println("Listening on :9853")
+		level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+			level.Error(logger).Log("msg", "HTTP server error", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	<-stop
-	log.Println("Shutdown signal received")
+	level.Info(logger).Log("msg", "Shutdown signal received")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	server.Shutdown(ctx)
 
-	shutdownAllSessions()
+	if bridgeCancel != nil {
+		bridgeCancel()
+	}
+	schedulerCancel()
+	cacheCancel()
+
+	prober.DefaultCache.Shutdown(logger)
 
-	log.Println("Exporter shut down cleanly")
+	level.Info(logger).Log("msg", "Exporter shut down cleanly")
 }
@@ -0,0 +1,413 @@
+package prober
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tcaine/twamp"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// Defaults for DefaultCache, overridden by main from --session.max and
+// --session.idle-timeout.
+const (
+	DefaultSessionCacheMax    = 256
+	DefaultSessionIdleTimeout = 5 * time.Minute
+	DefaultLivenessInterval   = 30 * time.Second
+	DefaultMaxProbesPerTarget = 4
+)
+
+var (
+	sessionCacheMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "twamp_session_cache",
+		Help: "State of the cached-session pool. 'active' is the current session count; 'created_total' and 'evicted_total' are monotonic counts tracked as gauges.",
+	}, []string{"state", "reason"})
+
+	probeWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "probe_wait_seconds",
+		Help:    "Time a probe spent waiting to acquire a cached TWAMP session before it could run.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sessionCacheMetric, probeWaitSeconds)
+}
+
+// sessionHandle is the subset of a live TWAMP session this package needs,
+// abstracted so Cache can be unit tested without a real TWAMP reflector.
+type sessionHandle interface {
+	TestConnection() error
+	RunMultiple(count uint64, callback twamp.TwampTestCallbackFunction, interval time.Duration, done <-chan bool) (*twamp.PingResults, error)
+	ReturnJSON(results *twamp.PingResults) string
+	Close()
+}
+
+type dialFunc func(m config.Module, target string) (sessionHandle, error)
+
+// cacheEntry is one cached session plus the bookkeeping Cache needs to
+// serialize access to it and decide when it's gone idle.
+type cacheEntry struct {
+	key      string
+	target   string
+	handle   sessionHandle
+	mu       sync.Mutex
+	lastUsed time.Time
+	// idleTimeout is the module's configured SessionExpiry at dial time,
+	// overriding the Cache's own idleTimeout for this entry. It's always
+	// positive in practice since config.Module.applyDefaults fills in
+	// DefaultSessionExpiry, but a zero value here just falls back to the
+	// Cache-wide default.
+	idleTimeout time.Duration
+}
+
+// Cache is an LRU pool of live TWAMP sessions, keyed by sessionKey. It caps
+// how many sessions are held open at once, evicts sessions that have sat
+// idle past their module's session_expiry (falling back to idleTimeout if
+// unset), and periodically liveness-checks the rest, evicting any that
+// fail. DefaultCache is the pool ProbeTWAMPSender uses; main reconfigures
+// it from CLI flags at startup.
+type Cache struct {
+	mu          sync.Mutex
+	entries     map[string]*list.Element // key -> element whose Value is *cacheEntry
+	lru         *list.List
+	maxSize     int
+	idleTimeout time.Duration
+	dial        dialFunc
+
+	semaMu  sync.Mutex
+	sema    map[string]*semaEntry
+	semaCap int
+}
+
+// semaEntry is the per-target concurrency limiter acquire hands out, plus
+// the bookkeeping pruneSema needs to evict ones that have gone idle. The
+// ad-hoc /probe path can be pointed at arbitrary operator-supplied targets,
+// so without pruning this map would grow without bound just like the
+// session map did before it got an LRU.
+type semaEntry struct {
+	ch       chan struct{}
+	lastUsed time.Time
+}
+
+// NewCache returns an empty Cache that dials real TWAMP sessions.
+func NewCache(maxSize int, idleTimeout time.Duration) *Cache {
+	return newCache(maxSize, idleTimeout, dialSession)
+}
+
+func newCache(maxSize int, idleTimeout time.Duration, dial dialFunc) *Cache {
+	return &Cache{
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		maxSize:     maxSize,
+		idleTimeout: idleTimeout,
+		dial:        dial,
+		sema:        make(map[string]*semaEntry),
+		semaCap:     DefaultMaxProbesPerTarget,
+	}
+}
+
+// DefaultCache is the session pool used by ProbeTWAMPSender. main replaces
+// it at startup once --session.max and --session.idle-timeout are parsed.
+var DefaultCache = NewCache(DefaultSessionCacheMax, DefaultSessionIdleTimeout)
+
+// acquire blocks until a concurrency slot for target is free or ctx is
+// canceled, returning a release func to call when the caller is done.
+func (c *Cache) acquire(ctx context.Context, target string) (func(), error) {
+	c.semaMu.Lock()
+	se, ok := c.sema[target]
+	if !ok {
+		se = &semaEntry{ch: make(chan struct{}, c.semaCap)}
+		c.sema[target] = se
+	}
+	se.lastUsed = time.Now()
+	c.semaMu.Unlock()
+
+	select {
+	case se.ch <- struct{}{}:
+		return func() {
+			<-se.ch
+			c.semaMu.Lock()
+			se.lastUsed = time.Now()
+			c.semaMu.Unlock()
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pruneSema drops per-target semaphore entries that have had no probe
+// in flight and no acquire for longer than idleTimeout, so the ad-hoc
+// /probe path's semaphore map doesn't grow without bound the same way the
+// session map used to.
+func (c *Cache) pruneSema(logger log.Logger) {
+	if c.idleTimeout <= 0 {
+		return
+	}
+
+	c.semaMu.Lock()
+	defer c.semaMu.Unlock()
+
+	for target, se := range c.sema {
+		if len(se.ch) == 0 && time.Since(se.lastUsed) > c.idleTimeout {
+			delete(c.sema, target)
+			level.Debug(logger).Log("msg", "Pruned idle per-target probe semaphore", "target", target)
+		}
+	}
+}
+
+// getOrDial returns the cache entry for (m, target), dialing and inserting
+// one if it isn't already cached, and evicting the least-recently-used
+// entry first if that would put the cache over maxSize.
+func (c *Cache) getOrDial(m config.Module, target string, logger log.Logger) (*cacheEntry, error) {
+	key := sessionKey(m, target)
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry), nil
+	}
+	c.mu.Unlock()
+
+	handle, err := c.dial(m, target)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{key: key, target: target, handle: handle, lastUsed: time.Now(), idleTimeout: m.SessionExpiry}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		// Lost a race with another dial for the same key; keep the one
+		// already installed and throw ours away.
+		c.mu.Unlock()
+		handle.Close()
+		c.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry), nil
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	sessionCacheMetric.WithLabelValues("created_total", "").Inc()
+	c.mu.Unlock()
+
+	level.Debug(logger).Log("msg", "Created cached TWAMP session", "target", target)
+	c.evictOverflow(logger)
+	c.reportActive()
+
+	return entry, nil
+}
+
+// evictOverflow evicts least-recently-used entries until the cache is back
+// at or under maxSize.
+func (c *Cache) evictOverflow(logger log.Logger) {
+	for {
+		c.mu.Lock()
+		if c.maxSize <= 0 || c.lru.Len() <= c.maxSize {
+			c.mu.Unlock()
+			return
+		}
+		back := c.lru.Back()
+		c.mu.Unlock()
+		if back == nil {
+			return
+		}
+		c.evict(back.Value.(*cacheEntry), "idle", logger)
+	}
+}
+
+// evict removes entry from the cache and closes its session. reason is one
+// of "idle", "error", or "shutdown", recorded on twamp_session_cache. The
+// caller must not be holding entry.mu.
+func (c *Cache) evict(entry *cacheEntry, reason string, logger log.Logger) {
+	if !c.unlink(entry) {
+		return
+	}
+
+	entry.mu.Lock()
+	entry.handle.Close()
+	entry.mu.Unlock()
+
+	c.recordEviction(entry, reason, logger)
+}
+
+// evictLocked is evict for a caller that already holds entry.mu - WithSession
+// calls this from inside its own fn so it doesn't try to re-lock entry.mu.
+func (c *Cache) evictLocked(entry *cacheEntry, reason string, logger log.Logger) {
+	if !c.unlink(entry) {
+		return
+	}
+
+	entry.handle.Close()
+
+	c.recordEviction(entry, reason, logger)
+}
+
+// unlink removes entry from the cache's map and LRU list, reporting whether
+// it was still present.
+func (c *Cache) unlink(entry *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[entry.key]
+	if !ok {
+		return false
+	}
+	delete(c.entries, entry.key)
+	c.lru.Remove(el)
+	return true
+}
+
+// isCached reports whether entry is still the one installed in the cache
+// under its key, i.e. hasn't been unlinked by a concurrent evict.
+func (c *Cache) isCached(entry *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[entry.key]
+	return ok && el.Value.(*cacheEntry) == entry
+}
+
+func (c *Cache) recordEviction(entry *cacheEntry, reason string, logger log.Logger) {
+	sessionCacheMetric.WithLabelValues("evicted_total", reason).Inc()
+	c.reportActive()
+	level.Debug(logger).Log("msg", "Evicted TWAMP session", "target", entry.target, "reason", reason)
+}
+
+func (c *Cache) reportActive() {
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+	sessionCacheMetric.WithLabelValues("active", "").Set(float64(n))
+}
+
+// WithSession runs fn against the cached session for (m, target), dialing
+// one if needed, bounding how many probes may run against target
+// concurrently, and evicting the session if fn (or acquiring its lock)
+// returns an error - matching the "evict on any error" requirement that
+// used to only match io.EOF.
+func (c *Cache) WithSession(ctx context.Context, m config.Module, target string, logger log.Logger, fn func(sessionHandle) error) error {
+	release, err := c.acquire(ctx, target)
+	if err != nil {
+		return fmt.Errorf("waiting for probe slot: %w", err)
+	}
+	defer release()
+
+	waitStart := time.Now()
+
+	// getOrDial can hand back an entry the janitor then evicts (and closes)
+	// before we get entry.mu locked below. Re-check the entry is still
+	// mapped once we hold its lock, and redial if it isn't, so fn never
+	// runs against a closed session. Bail out on ctx instead of retrying
+	// forever if eviction churn keeps losing that race.
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		entry, err := c.getOrDial(m, target, logger)
+		if err != nil {
+			return fmt.Errorf("dialing TWAMP session: %w", err)
+		}
+
+		entry.mu.Lock()
+		if !c.isCached(entry) {
+			entry.mu.Unlock()
+			continue
+		}
+
+		probeWaitSeconds.Observe(time.Since(waitStart).Seconds())
+		entry.lastUsed = time.Now()
+
+		err = fn(entry.handle)
+		if err != nil {
+			c.evictLocked(entry, "error", logger)
+		}
+		entry.mu.Unlock()
+		return err
+	}
+}
+
+// Run starts the janitor loop: every DefaultLivenessInterval it evicts
+// sessions idle past idleTimeout, then liveness-checks the survivors and
+// evicts any that fail. It blocks until ctx is canceled.
+func (c *Cache) Run(ctx context.Context, logger log.Logger) {
+	ticker := time.NewTicker(DefaultLivenessInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep(logger)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep evicts idle sessions, then liveness-checks and evicts any session
+// whose TestConnection fails. An entry's own idleTimeout - the dialing
+// module's configured session_expiry - takes precedence over the Cache's
+// idleTimeout, so e.g. a module with a short session_expiry gets its
+// sessions recycled sooner than the --session.idle-timeout default.
+//
+// The liveness check deliberately uses TestConnection rather than a
+// zero-probe RunMultiple: in the tcaine/twamp library a count of 0 means
+// "run until told to stop," not "run zero probes," so calling RunMultiple
+// here would pin the session to an unbounded test run instead of checking
+// it. TestConnection does a lightweight round trip over the same
+// TWAMP-Control TCP connection the test session rides on, which is enough
+// to detect a reflector that's gone away.
+func (c *Cache) sweep(logger log.Logger) {
+	c.pruneSema(logger)
+
+	for _, entry := range c.snapshot() {
+		entry.mu.Lock()
+		idle := time.Since(entry.lastUsed)
+		idleTimeout := entry.idleTimeout
+		entry.mu.Unlock()
+
+		if idleTimeout <= 0 {
+			idleTimeout = c.idleTimeout
+		}
+		if idleTimeout > 0 && idle > idleTimeout {
+			c.evict(entry, "idle", logger)
+			continue
+		}
+
+		entry.mu.Lock()
+		err := entry.handle.TestConnection()
+		entry.mu.Unlock()
+		if err != nil {
+			level.Debug(logger).Log("msg", "TWAMP session failed liveness check", "target", entry.target, "err", err)
+			c.evict(entry, "error", logger)
+		}
+	}
+}
+
+func (c *Cache) snapshot() []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*cacheEntry, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*cacheEntry))
+	}
+	return entries
+}
+
+// Shutdown evicts every cached session. It's called from main during a
+// graceful exporter shutdown.
+func (c *Cache) Shutdown(logger log.Logger) {
+	level.Info(logger).Log("msg", "Shutting down TWAMP session cache")
+	for _, entry := range c.snapshot() {
+		c.evict(entry, "shutdown", logger)
+	}
+}
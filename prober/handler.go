@@ -0,0 +1,199 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// DefaultHistorySize is how many probe results Handler keeps per target in
+// DefaultHistory.
+const DefaultHistorySize = 100
+
+// DefaultHistory records every probe Handler runs, for inspection via the
+// /probe/history debug endpoint.
+var DefaultHistory = NewHistory(DefaultHistorySize)
+
+// Handler selects the module named by the `module` query parameter,
+// dispatches to its registered ProbeFn, serves the resulting metrics, and
+// records the outcome in DefaultHistory. It is exported so the package can
+// be exercised without an HTTP server. With `?debug=true`, it instead
+// returns the per-probe log output and the metrics that would have been
+// scraped, as plain text, matching blackbox_exporter's debug-probe UX.
+func Handler(w http.ResponseWriter, r *http.Request, cfg *config.Config, logger log.Logger) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := cfg.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	probeFn, ok := Probers[module.Prober]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown prober %q", module.Prober), http.StatusBadRequest)
+		return
+	}
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was successful",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Duration of the probe",
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess)
+	registry.MustRegister(probeDuration)
+
+	probeSuccess.Set(0)
+
+	sl := newScrapeLogger(logger, moduleName, target)
+
+	// The caller (main.go) hands us r's context with no deadline of its
+	// own; a fixed timeout here doesn't work across modules, since e.g.
+	// voip_ef's 20 packets at 200ms apart need ~4s to send by themselves.
+	ctx, cancel := context.WithTimeout(r.Context(), module.ProbeDeadline())
+	defer cancel()
+
+	start := time.Now()
+	success := probeFn(ctx, target, module, registry, sl)
+	duration := time.Since(start)
+	if success {
+		probeSuccess.Set(1)
+		level.Info(sl).Log("msg", "Probe succeeded", "duration_seconds", duration.Seconds())
+	} else {
+		level.Error(sl).Log("msg", "Probe failed", "duration_seconds", duration.Seconds())
+	}
+	probeDuration.Set(duration.Seconds())
+
+	entry := HistoryEntry{
+		Timestamp: start,
+		Module:    moduleName,
+		Success:   success,
+		Duration:  duration,
+	}
+	if !success {
+		entry.Error = "probe failed, see exporter logs"
+	}
+	DefaultHistory.Record(target, entry)
+
+	if params.Get("debug") == "true" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(DebugOutput(&module, &sl.buffer, registry)))
+		return
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeLogger wraps a go-kit logger so that every line logged during a
+// single probe is both forwarded to the real logger (at debug level) and
+// retained in an in-memory buffer for the `debug=true` response.
+type scrapeLogger struct {
+	next         log.Logger
+	buffer       bytes.Buffer
+	bufferLogger log.Logger
+}
+
+func newScrapeLogger(logger log.Logger, moduleName, target string) *scrapeLogger {
+	logger = log.With(logger, "module", moduleName, "target", target)
+	sl := &scrapeLogger{next: logger}
+	bl := log.NewLogfmtLogger(&sl.buffer)
+	sl.bufferLogger = log.With(bl, "ts", log.DefaultTimestampUTC, "caller", log.Caller(6), "module", moduleName, "target", target)
+	return sl
+}
+
+// Log implements log.Logger. It writes every entry to the buffer at its
+// original level, but downgrades what reaches the real logger to debug so a
+// normally-quiet exporter doesn't get noisy just because probes ran.
+func (sl *scrapeLogger) Log(keyvals ...interface{}) error {
+	sl.bufferLogger.Log(keyvals...)
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 0; i < len(kvs); i += 2 {
+		if kvs[i] == level.Key() {
+			kvs[i+1] = level.DebugValue()
+		}
+	}
+	return sl.next.Log(kvs...)
+}
+
+// DebugOutput renders the logs captured for a probe, the registered
+// collectors and the metrics they would have returned, and the module
+// configuration used, as the plain-text body for `/probe?debug=true`.
+func DebugOutput(module *config.Module, logBuffer *bytes.Buffer, registry *prometheus.Registry) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Logs for the probe:\n")
+	logBuffer.WriteTo(buf)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintf(buf, "\n\nError gathering metrics: %s\n", err)
+		return buf.String()
+	}
+
+	names := make([]string, 0, len(mfs))
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	sort.Strings(names)
+	fmt.Fprintf(buf, "\n\nRegistered collectors:\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "  %s\n", name)
+	}
+
+	fmt.Fprintf(buf, "\n\nMetrics that would have been returned:\n")
+	for _, mf := range mfs {
+		expfmt.MetricFamilyToText(buf, mf)
+	}
+
+	fmt.Fprintf(buf, "\n\nModule configuration:\n")
+	c, err := yaml.Marshal(module)
+	if err != nil {
+		fmt.Fprintf(buf, "Error marshalling config: %s\n", err)
+	} else {
+		buf.Write(c)
+	}
+
+	return buf.String()
+}
+
+// HistoryHandler serves the recorded probe history as JSON. With no `target`
+// query parameter it returns every target's history; with one, just that
+// target's.
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	target := r.URL.Query().Get("target")
+	if target != "" {
+		json.NewEncoder(w).Encode(DefaultHistory.Target(target))
+		return
+	}
+	json.NewEncoder(w).Encode(DefaultHistory.All())
+}
@@ -0,0 +1,69 @@
+package prober
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryEntry records the outcome of a single probe run.
+type HistoryEntry struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Module    string        `json:"module"`
+	Success   bool          `json:"success"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// History is a fixed-size, per-target ring buffer of recent probe results,
+// inspectable via the /probe/history debug endpoint.
+type History struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string][]HistoryEntry
+}
+
+// NewHistory returns a History that keeps the last size results per target.
+func NewHistory(size int) *History {
+	return &History{
+		size:    size,
+		entries: make(map[string][]HistoryEntry),
+	}
+}
+
+// Record appends e to target's ring buffer, evicting the oldest entry once
+// the buffer is full.
+func (h *History) Record(target string, e HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := append(h.entries[target], e)
+	if len(entries) > h.size {
+		entries = entries[len(entries)-h.size:]
+	}
+	h.entries[target] = entries
+}
+
+// Target returns the recorded history for target, oldest first.
+func (h *History) Target(target string) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.entries[target]
+	out := make([]HistoryEntry, len(entries))
+	copy(out, entries)
+	return out
+}
+
+// All returns a snapshot of every target's recorded history.
+func (h *History) All() map[string][]HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string][]HistoryEntry, len(h.entries))
+	for target, entries := range h.entries {
+		cp := make([]HistoryEntry, len(entries))
+		copy(cp, entries)
+		out[target] = cp
+	}
+	return out
+}
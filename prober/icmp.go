@@ -0,0 +1,98 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// ProbeICMP sends a single unprivileged ICMP echo request to target and
+// measures the round-trip time. It uses the "udp4" network, which relies on
+// the host's net.ipv4.ping_group_range allowing the exporter's GID to send
+// ICMP echoes without CAP_NET_RAW.
+func ProbeICMP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	rttGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "icmp_rtt_seconds",
+		Help: "Round-trip time of the ICMP echo",
+	})
+	registry.MustRegister(rttGauge)
+
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to open ICMP listener", "err", err)
+		return false
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(module.Timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		level.Error(logger).Log("msg", "failed to set ICMP deadline", "err", err)
+		return false
+	}
+
+	dst, err := net.ResolveIPAddr("ip4", target)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to resolve target", "target", target, "err", err)
+		return false
+	}
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  1,
+			Data: []byte("twamp-exporter"),
+		},
+	}
+
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to marshal ICMP echo", "err", err)
+		return false
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(wb, &net.UDPAddr{IP: dst.IP}); err != nil {
+		level.Error(logger).Log("msg", "failed to send ICMP echo", "target", target, "err", err)
+		return false
+	}
+
+	rb := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(rb)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read ICMP reply", "target", target, "err", err)
+			return false
+		}
+
+		rm, err := icmp.ParseMessage(1 /* ipv4.ICMPTypeEchoReply.Protocol() */, rb[:n])
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to parse ICMP reply", "err", err)
+			return false
+		}
+
+		switch rm.Type {
+		case ipv4.ICMPTypeEchoReply:
+			rttGauge.Set(time.Since(start).Seconds())
+			return true
+		default:
+			level.Debug(logger).Log("msg", "ignoring unexpected ICMP message", "type", fmt.Sprintf("%v", rm.Type))
+			continue
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Package prober implements the pluggable probe types the exporter can run
+// against a target, modeled on blackbox_exporter's prober.ProbeFn design.
+package prober
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// ProbeFn executes one probe against target using module's parameters,
+// registering whatever metrics it gathers on registry, and returns whether
+// the probe succeeded.
+type ProbeFn func(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool
+
+// Probers maps a module's `prober` name to the function that runs it.
+var Probers = map[string]ProbeFn{
+	"twamp_sender":    ProbeTWAMPSender,
+	"twamp_reflector": ProbeTWAMPReflector,
+	"tcp_connect":     ProbeTCP,
+	"icmp":            ProbeICMP,
+}
@@ -0,0 +1,311 @@
+package prober
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tcaine/twamp"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// Metrics exported by the background scheduler. Unlike the gauges Handler
+// registers per /probe scrape, these are persistent collectors registered
+// once on the default registry, labeled by target and module, so operators
+// get a full latency distribution across every packet sent rather than only
+// the min/max/avg/stddev of whatever batch happened to run during a scrape.
+var (
+	probesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "twamp_probes_total",
+		Help: "Total number of TWAMP test packets sent by the background scheduler.",
+	}, []string{"target", "module"})
+
+	probesFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "twamp_probes_failed_total",
+		Help: "Total number of TWAMP test packets sent by the background scheduler that went unanswered.",
+	}, []string{"target", "module"})
+
+	rttSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "twamp_rtt_seconds",
+		Help:    "Round-trip time of individual TWAMP test packets sent by the background scheduler.",
+		Buckets: prometheus.ExponentialBucketsRange(100e-6, 1, 20),
+	}, []string{"target", "module"})
+
+	oneWaySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "twamp_one_way_seconds",
+		Help:    "One-way delay of individual TWAMP test packets sent by the background scheduler.",
+		Buckets: prometheus.ExponentialBucketsRange(100e-6, 1, 20),
+	}, []string{"target", "module", "direction"})
+
+	lastProbeTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "twamp_last_probe_timestamp_seconds",
+		Help: "Unix timestamp of the last TWAMP test reply received by the background scheduler.",
+	}, []string{"target", "module"})
+)
+
+func init() {
+	prometheus.MustRegister(probesTotal, probesFailedTotal, rttSeconds, oneWaySeconds, lastProbeTimestamp)
+}
+
+// ReloadPollInterval is how often Scheduler.Run checks whether a SafeConfig
+// reload changed the set of background targets or their modules.
+const ReloadPollInterval = 5 * time.Second
+
+// stopGracePeriod bounds how long reconcileTargets waits for a removed or
+// changed target's goroutine to actually return before giving up on it. It's
+// its own constant rather than reusing ReloadPollInterval so tuning how often
+// reloads are picked up doesn't also change how much teardown time a session
+// gets.
+const stopGracePeriod = 5 * time.Second
+
+// Scheduler runs a continuous TWAMP test, rather than a bounded batch of
+// module.ProbeCount packets, against every (module, target) pair declared
+// in the config's Targets list. It exists alongside Handler and the ad-hoc
+// /probe endpoint, not in place of it; on-demand probes keep working
+// exactly as before.
+type Scheduler struct {
+	logger log.Logger
+	// runFn is s.run by default, overridden in tests so reconcileTargets'
+	// start/stop bookkeeping can be exercised without dialing a real TWAMP
+	// session.
+	runFn func(ctx context.Context, target, moduleName string, module config.Module)
+}
+
+// NewScheduler returns a Scheduler that logs through logger.
+func NewScheduler(logger log.Logger) *Scheduler {
+	s := &Scheduler{logger: logger}
+	s.runFn = s.run
+	return s
+}
+
+// targetKey identifies one (target, module name) pair Run tracks a
+// goroutine for. It's a struct rather than a concatenated string so
+// target/module names containing the same separator can't collide.
+type targetKey struct {
+	target, moduleName string
+}
+
+// scheduledTarget is one (target, module) pair Run currently has a
+// background goroutine running for.
+type scheduledTarget struct {
+	target, moduleName string
+	module             config.Module
+}
+
+// runningTarget is the bookkeeping Run keeps for a scheduledTarget's
+// goroutine, so a later reload can cancel it if the target or module
+// disappears or changes. done is closed once the goroutine actually
+// returns, so a restart on module change can wait for it to let go of its
+// session's fixed sender/receiver ports before dialing a new one.
+type runningTarget struct {
+	scheduledTarget
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Run starts one background goroutine per configured target and blocks
+// until ctx is canceled. It polls sc every ReloadPollInterval and
+// reconciles the running goroutines against whatever config a SIGHUP
+// reload most recently swapped in: goroutines for targets that were
+// removed, or whose module changed, are canceled, and goroutines for
+// newly added targets are started - so background probes pick up a
+// reload the same way /probe already does, without an exporter restart.
+func (s *Scheduler) Run(ctx context.Context, sc *config.SafeConfig) {
+	running := make(map[targetKey]runningTarget)
+	var lastCfg *config.Config
+
+	reconcile := func() {
+		cfg := sc.Get()
+		if cfg == lastCfg {
+			return
+		}
+		lastCfg = cfg
+		s.reconcileTargets(ctx, cfg, running)
+	}
+
+	reconcile()
+
+	ticker := time.NewTicker(ReloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reconcile()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileTargets updates running in place to match cfg: entries for
+// targets that were removed, or whose module changed, are canceled,
+// waited on, and have their metric series cleared so a decommissioned
+// target's gauges don't stay frozen in /metrics forever; entries for
+// newly added (target, module) pairs are started via s.runFn.
+func (s *Scheduler) reconcileTargets(ctx context.Context, cfg *config.Config, running map[targetKey]runningTarget) {
+	desired := make(map[targetKey]scheduledTarget, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		module, ok := cfg.Modules[t.Module]
+		if !ok {
+			level.Error(s.logger).Log("msg", "Skipping background probe for unknown module", "target", t.Target, "module", t.Module)
+			continue
+		}
+		desired[targetKey{t.Target, t.Module}] = scheduledTarget{target: t.Target, moduleName: t.Module, module: module}
+	}
+
+	// Stop every entry that was removed or whose module changed, waiting
+	// for each (in parallel, so N simultaneous changes don't serialize into
+	// N*stopGracePeriod) to actually return before clearing its metrics
+	// or letting a same-target replacement start. dialSession binds the
+	// module's fixed SenderPort/ReceiverPort, so starting a replacement
+	// before the old session has actually closed risks racing it for the
+	// same local ports; an in-flight reply landing after we'd already
+	// cleared the metrics would also just repopulate them. Each wait is
+	// capped at stopGracePeriod in case a goroutine is stuck (e.g. mid
+	// dial), so one slow target can't stall the others indefinitely.
+	var wg sync.WaitGroup
+	for key, rt := range running {
+		if st, ok := desired[key]; ok && st.module == rt.module {
+			continue
+		}
+		delete(running, key)
+
+		rt.cancel()
+		wg.Add(1)
+		go func(rt runningTarget) {
+			defer wg.Done()
+			select {
+			case <-rt.done:
+			case <-time.After(stopGracePeriod):
+				level.Error(s.logger).Log("msg", "Old background probe session did not stop in time", "target", rt.target, "module", rt.moduleName)
+			}
+			deleteScheduledMetrics(rt.target, rt.moduleName)
+		}(rt)
+	}
+	wg.Wait()
+
+	for key, st := range desired {
+		if _, ok := running[key]; ok {
+			continue
+		}
+		running[key] = s.startTarget(ctx, st)
+	}
+}
+
+// startTarget launches a background probe goroutine for st and returns the
+// bookkeeping reconcileTargets uses to track and later stop it.
+func (s *Scheduler) startTarget(ctx context.Context, st scheduledTarget) runningTarget {
+	targetCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runFn(targetCtx, st.target, st.moduleName, st.module)
+	}()
+	return runningTarget{scheduledTarget: st, cancel: cancel, done: done}
+}
+
+// deleteScheduledMetrics drops every series reconcileTargets' callback may
+// have recorded for (target, moduleName), so a target removed (or moved to
+// a different module) by a reload stops showing up in /metrics instead of
+// leaving its last values frozen there indefinitely.
+func deleteScheduledMetrics(target, moduleName string) {
+	probesTotal.DeleteLabelValues(target, moduleName)
+	probesFailedTotal.DeleteLabelValues(target, moduleName)
+	rttSeconds.DeleteLabelValues(target, moduleName)
+	oneWaySeconds.DeleteLabelValues(target, moduleName, "forward")
+	oneWaySeconds.DeleteLabelValues(target, moduleName, "reverse")
+	lastProbeTimestamp.DeleteLabelValues(target, moduleName)
+}
+
+// run owns a dedicated TWAMP session for (target, module) - separate from
+// the ad-hoc cache in twamp.go - for as long as ctx is live, reconnecting
+// after any session error.
+func (s *Scheduler) run(ctx context.Context, target, moduleName string, module config.Module) {
+	logger := log.With(s.logger, "target", target, "module", moduleName)
+
+	for ctx.Err() == nil {
+		sess, err := dialSession(module, target)
+		if err != nil {
+			level.Error(logger).Log("msg", "Background probe session failed", "err", err)
+			if !sleep(ctx, module.Timeout) {
+				return
+			}
+			continue
+		}
+
+		level.Info(logger).Log("msg", "Starting continuous background probe")
+		_, err = s.runSession(ctx, sess, target, moduleName, module)
+		sess.Close()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Background probe session ended, reconnecting", "err", err)
+		}
+		if !sleep(ctx, module.Timeout) {
+			return
+		}
+	}
+}
+
+// runSession runs packets continuously (count 0) until ctx is canceled or
+// the session errors out, recording every reply as it arrives. probesTotal
+// and probesFailedTotal are advanced from the callback rather than from
+// the final PingResultStats, so a long-lived target's rate stays meaningful
+// between scrapes instead of sitting at zero until the session tears down.
+//
+// The callback only fires for packets that came back, so a dropped packet
+// never gets a callback of its own; it's detected as a gap in
+// TwampResults.SenderSeqNum once the next reply arrives, and charged to
+// probesFailedTotal (and probesTotal) at that point.
+func (s *Scheduler) runSession(ctx context.Context, sess sessionHandle, target, moduleName string, module config.Module) (*twamp.PingResults, error) {
+	stop := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-done:
+		}
+	}()
+	defer close(done)
+
+	lastSeq := int64(-1)
+
+	return sess.RunMultiple(0, func(r *twamp.TwampResults) {
+		if r.IsDuplicate {
+			return
+		}
+
+		seq := int64(r.SenderSeqNum)
+		if lastSeq >= 0 && seq > lastSeq+1 {
+			lost := float64(seq - lastSeq - 1)
+			probesTotal.WithLabelValues(target, moduleName).Add(lost)
+			probesFailedTotal.WithLabelValues(target, moduleName).Add(lost)
+		}
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+
+		probesTotal.WithLabelValues(target, moduleName).Inc()
+		rttSeconds.WithLabelValues(target, moduleName).Observe(r.GetRTT().Seconds())
+		oneWaySeconds.WithLabelValues(target, moduleName, "forward").Observe(r.ReceiveTimestamp.Sub(r.SenderTimestamp).Seconds())
+		oneWaySeconds.WithLabelValues(target, moduleName, "reverse").Observe(r.FinishedTimestamp.Sub(r.Timestamp).Seconds())
+		lastProbeTimestamp.WithLabelValues(target, moduleName).SetToCurrentTime()
+	}, module.ProbeInterval, stop)
+}
+
+// sleep waits for d, returning false early if ctx is canceled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package prober
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// recordingRunFn is a Scheduler.runFn stand-in that records each start and
+// blocks until ctx is canceled, so reconcileTargets' start/stop bookkeeping
+// can be tested without dialing a real TWAMP session. started fires once
+// per call, after the start is recorded, so tests can wait for a goroutine
+// to actually run instead of racing the scheduler that spawned it.
+type recordingRunFn struct {
+	mu      sync.Mutex
+	starts  []scheduledTarget
+	started chan struct{}
+}
+
+func newRecordingRunFn() *recordingRunFn {
+	return &recordingRunFn{started: make(chan struct{}, 16)}
+}
+
+func (r *recordingRunFn) run(ctx context.Context, target, moduleName string, module config.Module) {
+	r.mu.Lock()
+	r.starts = append(r.starts, scheduledTarget{target: target, moduleName: moduleName, module: module})
+	r.mu.Unlock()
+	r.started <- struct{}{}
+	<-ctx.Done()
+}
+
+func (r *recordingRunFn) startCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.starts)
+}
+
+// waitStarts blocks until at least n runFn calls have recorded a start, or
+// fails the test after a short timeout.
+func (r *recordingRunFn) waitStarts(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for r.startCount() < n {
+		select {
+		case <-r.started:
+		case <-deadline:
+			t.Fatalf("timed out waiting for %d starts, got %d", n, r.startCount())
+		}
+	}
+}
+
+func testScheduler() (*Scheduler, *recordingRunFn) {
+	rec := newRecordingRunFn()
+	s := &Scheduler{logger: log.NewNopLogger(), runFn: rec.run}
+	return s, rec
+}
+
+func TestReconcileTargetsStartsNewTargets(t *testing.T) {
+	s, rec := testScheduler()
+	running := make(map[targetKey]runningTarget)
+
+	m := testModule("default")
+	cfg := &config.Config{
+		Modules: map[string]config.Module{"default": m},
+		Targets: []config.TargetConfig{{Target: "10.0.0.1", Module: "default"}},
+	}
+
+	s.reconcileTargets(context.Background(), cfg, running)
+	rec.waitStarts(t, 1)
+
+	if len(running) != 1 {
+		t.Fatalf("running = %d entries, want 1", len(running))
+	}
+	if got := rec.startCount(); got != 1 {
+		t.Fatalf("starts = %d, want 1", got)
+	}
+}
+
+func TestReconcileTargetsStopsRemovedTargets(t *testing.T) {
+	s, rec := testScheduler()
+	running := make(map[targetKey]runningTarget)
+
+	m := testModule("default")
+	cfg := &config.Config{
+		Modules: map[string]config.Module{"default": m},
+		Targets: []config.TargetConfig{{Target: "10.0.0.1", Module: "default"}},
+	}
+	s.reconcileTargets(context.Background(), cfg, running)
+	rec.waitStarts(t, 1)
+	if got := rec.startCount(); got != 1 {
+		t.Fatalf("starts = %d, want 1", got)
+	}
+
+	// Dropping the target from the next config should cancel its goroutine
+	// and remove it from the running set.
+	emptyCfg := &config.Config{Modules: map[string]config.Module{"default": m}}
+	s.reconcileTargets(context.Background(), emptyCfg, running)
+
+	if len(running) != 0 {
+		t.Fatalf("running = %d entries, want 0 after target removed", len(running))
+	}
+}
+
+func TestReconcileTargetsRestartsOnModuleChange(t *testing.T) {
+	s, rec := testScheduler()
+	running := make(map[targetKey]runningTarget)
+
+	m1 := testModule("default")
+	cfg1 := &config.Config{
+		Modules: map[string]config.Module{"default": m1},
+		Targets: []config.TargetConfig{{Target: "10.0.0.1", Module: "default"}},
+	}
+	s.reconcileTargets(context.Background(), cfg1, running)
+	rec.waitStarts(t, 1)
+
+	m2 := testModule("default")
+	m2.Timeout = 10 * time.Second
+	cfg2 := &config.Config{
+		Modules: map[string]config.Module{"default": m2},
+		Targets: []config.TargetConfig{{Target: "10.0.0.1", Module: "default"}},
+	}
+	s.reconcileTargets(context.Background(), cfg2, running)
+	rec.waitStarts(t, 2)
+
+	if got := rec.startCount(); got != 2 {
+		t.Fatalf("starts = %d, want 2 (module change should restart the target)", got)
+	}
+	if len(running) != 1 {
+		t.Fatalf("running = %d entries, want 1", len(running))
+	}
+	if running[targetKey{"10.0.0.1", "default"}].module != m2 {
+		t.Errorf("running entry should hold the new module's parameters")
+	}
+}
+
+func TestReconcileTargetsSkipsUnknownModule(t *testing.T) {
+	s, rec := testScheduler()
+	running := make(map[targetKey]runningTarget)
+
+	cfg := &config.Config{
+		Modules: map[string]config.Module{},
+		Targets: []config.TargetConfig{{Target: "10.0.0.1", Module: "missing"}},
+	}
+	s.reconcileTargets(context.Background(), cfg, running)
+
+	if len(running) != 0 {
+		t.Fatalf("running = %d entries, want 0 for an unknown module", len(running))
+	}
+	if got := rec.startCount(); got != 0 {
+		t.Fatalf("starts = %d, want 0", got)
+	}
+}
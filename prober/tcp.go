@@ -0,0 +1,40 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+// ProbeTCP checks plain TCP reachability of target:module.ControlPort,
+// independent of the TWAMP protocol. It's useful for confirming a
+// reflector's control port is reachable before troubleshooting TWAMP
+// session failures further.
+func ProbeTCP(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcp_connect_duration_seconds",
+		Help: "Duration of the TCP connect",
+	})
+	registry.MustRegister(durationGauge)
+
+	addr := fmt.Sprintf("%s:%d", target, module.ControlPort)
+
+	start := time.Now()
+	d := net.Dialer{Timeout: module.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	durationGauge.Set(time.Since(start).Seconds())
+	if err != nil {
+		level.Error(logger).Log("msg", "TCP connect failed", "target", addr, "err", err)
+		return false
+	}
+	conn.Close()
+
+	return true
+}
@@ -0,0 +1,205 @@
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tcaine/twamp"
+
+	"github.com/adammmmm/twamp-exporter/config"
+)
+
+type twampOutput struct {
+	Results any        `json:"results"`
+	Stat    twampStats `json:"stats"`
+}
+
+type twampStats struct {
+	Min         time.Duration `json:"min"`
+	Max         time.Duration `json:"max"`
+	Avg         time.Duration `json:"avg"`
+	StdDev      time.Duration `json:"stddev"`
+	Transmitted int           `json:"tx"`
+	Received    int           `json:"rx"`
+	Loss        float64       `json:"loss"`
+}
+
+// realSession adapts a dialed *twamp.TwampConnection/Session/Test to the
+// sessionHandle interface the cache deals in, so the cache's own logic can
+// be exercised in tests against a fake instead.
+type realSession struct {
+	conn    *twamp.TwampConnection
+	session *twamp.TwampSession
+	test    *twamp.TwampTest
+}
+
+func (r *realSession) TestConnection() error {
+	return r.session.TestConnection()
+}
+
+func (r *realSession) RunMultiple(count uint64, callback twamp.TwampTestCallbackFunction, interval time.Duration, done <-chan bool) (*twamp.PingResults, error) {
+	return r.test.RunMultiple(count, callback, interval, done)
+}
+
+func (r *realSession) ReturnJSON(results *twamp.PingResults) string {
+	return r.test.ReturnJSON(results)
+}
+
+func (r *realSession) Close() {
+	r.session.Stop()
+	r.conn.Close()
+}
+
+// sessionKey scopes a cached session to the target and to every module
+// field that changes how the session is negotiated, since two modules
+// probing the same target (e.g. voip_ef vs bulk_be) must not share a
+// session.
+func sessionKey(m config.Module, target string) string {
+	return fmt.Sprintf("%s|%d|%d|%d|%d|%s", target, m.ControlPort, m.SenderPort, m.ReceiverPort, m.Padding, m.DSCP)
+}
+
+// dialSession completes the TWAMP-Control handshake against target and
+// creates a Test-Session plus the TwampTest used to run it. It is the
+// Cache's default dialFunc.
+func dialSession(m config.Module, target string) (sessionHandle, error) {
+	tos, err := m.TOS()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := fmt.Sprintf("%s:%d", target, m.ControlPort)
+	c := twamp.NewClient()
+
+	conn, err := c.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.CreateSession(twamp.TwampSessionConfig{
+		SenderPort:   m.SenderPort,
+		ReceiverPort: m.ReceiverPort,
+		Timeout:      int(m.Timeout.Seconds()),
+		Padding:      m.Padding,
+		TOS:          tos,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	test, err := session.CreateTest()
+	if err != nil {
+		session.Stop()
+		conn.Close()
+		return nil, err
+	}
+
+	return &realSession{conn: conn, session: session, test: test}, nil
+}
+
+// ProbeTWAMPSender runs module.ProbeCount TWAMP-Test exchanges against
+// target's Test-Session-Reflector and records min/max/avg/stddev RTT plus
+// loss on registry.
+func ProbeTWAMPSender(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	durationGaugeVec := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "twamp_duration_seconds",
+			Help: "min/max/avg/stddev of twamp measurement",
+		},
+		[]string{"measurement"},
+	)
+	lostProbesGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "twamp_probes_lost",
+			Help: "Lost probes per measurement",
+		},
+	)
+
+	registry.MustRegister(durationGaugeVec)
+	registry.MustRegister(lostProbesGauge)
+
+	var o twampOutput
+	err := DefaultCache.WithSession(ctx, module, target, logger, func(s sessionHandle) error {
+		stop := make(chan bool)
+		done := make(chan struct{})
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				close(stop)
+			case <-done:
+			}
+		}()
+
+		results, err := s.RunMultiple(module.ProbeCount, nil, module.ProbeInterval, stop)
+		close(done)
+		if err != nil {
+			return fmt.Errorf("RunMultiple failed: %w", err)
+		}
+
+		return json.Unmarshal([]byte(s.ReturnJSON(results)), &o)
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "TWAMP probe failed", "target", target, "err", err)
+		return false
+	}
+
+	durationGaugeVec.WithLabelValues("min").Set(o.Stat.Min.Seconds())
+	durationGaugeVec.WithLabelValues("max").Set(o.Stat.Max.Seconds())
+	durationGaugeVec.WithLabelValues("avg").Set(o.Stat.Avg.Seconds())
+	durationGaugeVec.WithLabelValues("stddev").Set(o.Stat.StdDev.Seconds())
+	lostProbesGauge.Set(o.Stat.Loss)
+
+	return true
+}
+
+// ProbeTWAMPReflector checks that target's Test-Session-Reflector is alive
+// by completing the TWAMP-Control handshake and tearing the session back
+// down immediately, without sending any test packets. It's useful for
+// monitoring reflector availability independently of sender-side loss.
+func ProbeTWAMPReflector(ctx context.Context, target string, module config.Module, registry *prometheus.Registry, logger log.Logger) bool {
+	upGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "twamp_reflector_up",
+		Help: "Whether the TWAMP Test-Session-Reflector completed the control handshake",
+	})
+	registry.MustRegister(upGauge)
+
+	tos, err := module.TOS()
+	if err != nil {
+		level.Error(logger).Log("msg", "invalid module", "err", err)
+		return false
+	}
+
+	addr := fmt.Sprintf("%s:%d", target, module.ControlPort)
+	c := twamp.NewClient()
+
+	conn, err := c.Connect(addr)
+	if err != nil {
+		level.Error(logger).Log("msg", "reflector handshake failed", "target", target, "err", err)
+		upGauge.Set(0)
+		return false
+	}
+	defer conn.Close()
+
+	session, err := conn.CreateSession(twamp.TwampSessionConfig{
+		SenderPort:   module.SenderPort,
+		ReceiverPort: module.ReceiverPort,
+		Timeout:      int(module.Timeout.Seconds()),
+		Padding:      module.Padding,
+		TOS:          tos,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "reflector rejected session request", "target", target, "err", err)
+		upGauge.Set(0)
+		return false
+	}
+	defer session.Stop()
+
+	upGauge.Set(1)
+	return true
+}